@@ -0,0 +1,210 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// smallRequestBody is the largest request body SetCompressedBody will
+// buffer in full in order to report a real Content-Length. Bodies larger
+// than this are streamed through a pipe and sent with ContentLength left
+// at -1, which forces chunked transfer encoding.
+const smallRequestBody = 64 << 10 // 64KiB
+
+var (
+	gzipWriterPool = sync.Pool{
+		New: func() any { return gzip.NewWriter(io.Discard) },
+	}
+	flateWriterPool = sync.Pool{
+		New: func() any {
+			w, _ := flate.NewWriter(io.Discard, flate.DefaultCompression)
+			return w
+		},
+	}
+	brotliWriterPool = sync.Pool{
+		New: func() any { return brotli.NewWriter(io.Discard) },
+	}
+	zstdEncoderPool = sync.Pool{
+		New: func() any {
+			w, _ := zstd.NewWriter(io.Discard)
+			return w
+		},
+	}
+)
+
+// requestCompressors maps a Content-Encoding token to the function that
+// streams r through an encoder into w at the given level. A level of 0
+// means "use this package's pooled, library-default encoder"; any other
+// value builds a one-off encoder at that level instead, since pooling
+// only makes sense for a single, fixed level.
+var requestCompressors = map[string]func(w io.Writer, r io.Reader, level int) error{
+	"gzip":    compressGzip,
+	"deflate": compressDeflate,
+	"br":      compressBrotli,
+	"zstd":    compressZstd,
+}
+
+func compressGzip(w io.Writer, r io.Reader, level int) error {
+	if level == 0 {
+		gz := gzipWriterPool.Get().(*gzip.Writer)
+		defer gzipWriterPool.Put(gz)
+		gz.Reset(w)
+		if _, err := io.Copy(gz, r); err != nil {
+			return err
+		}
+		return gz.Close()
+	}
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(gz, r); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func compressDeflate(w io.Writer, r io.Reader, level int) error {
+	if level == 0 {
+		fw := flateWriterPool.Get().(*flate.Writer)
+		defer flateWriterPool.Put(fw)
+		fw.Reset(w)
+		if _, err := io.Copy(fw, r); err != nil {
+			return err
+		}
+		return fw.Close()
+	}
+	fw, err := flate.NewWriter(w, level)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, r); err != nil {
+		return err
+	}
+	return fw.Close()
+}
+
+func compressBrotli(w io.Writer, r io.Reader, level int) error {
+	if level == 0 {
+		bw := brotliWriterPool.Get().(*brotli.Writer)
+		defer brotliWriterPool.Put(bw)
+		bw.Reset(w)
+		if _, err := io.Copy(bw, r); err != nil {
+			return err
+		}
+		return bw.Close()
+	}
+	bw := brotli.NewWriterLevel(w, level)
+	if _, err := io.Copy(bw, r); err != nil {
+		return err
+	}
+	return bw.Close()
+}
+
+func compressZstd(w io.Writer, r io.Reader, level int) error {
+	if level == 0 {
+		zw := zstdEncoderPool.Get().(*zstd.Encoder)
+		defer zstdEncoderPool.Put(zw)
+		zw.Reset(w)
+		if _, err := io.Copy(zw, r); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+	zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// SetCompressedBody compresses body with the named Content-Encoding
+// ("gzip", "deflate", "br" or "zstd"), installs it as the request body,
+// and sets the Content-Encoding header accordingly. This is the
+// counterpart to DecompressBody, for APIs that accept compressed
+// uploads.
+//
+// Bodies up to smallRequestBody are buffered so r.ContentLength can be
+// set to the real compressed size; larger bodies are streamed through a
+// pooled encoder and sent with ContentLength -1 (chunked).
+func (r *Request) SetCompressedBody(body io.Reader, encoding string) error {
+	return r.setCompressedBodyLevel(body, encoding, 0)
+}
+
+func (r *Request) setCompressedBodyLevel(body io.Reader, encoding string, level int) error {
+	compress, ok := requestCompressors[encoding]
+	if !ok {
+		return fmt.Errorf("fhttp: unsupported request compression encoding %q", encoding)
+	}
+
+	var peek bytes.Buffer
+	n, err := io.CopyN(&peek, body, smallRequestBody+1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if n <= smallRequestBody {
+		var out bytes.Buffer
+		if err := compress(&out, &peek, level); err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(&out)
+		r.ContentLength = int64(out.Len())
+	} else {
+		pr, pw := io.Pipe()
+		full := io.MultiReader(&peek, body)
+		go func() {
+			pw.CloseWithError(compress(pw, full, level))
+		}()
+		r.Body = pr
+		r.ContentLength = -1
+	}
+
+	r.Header.Set("Content-Encoding", encoding)
+	return nil
+}
+
+// compressRequestBody applies the first encoding in t.RequestCompression
+// to req's body, using the matching per-algorithm level field, unless
+// the caller already set their own Content-Encoding or didn't configure
+// RequestCompression at all. This lets an API's compressed-upload
+// support be opted into globally on Transport, instead of calling
+// SetCompressedBody on every outgoing *Request by hand.
+func (t *Transport) compressRequestBody(req *Request) error {
+	if len(t.RequestCompression) == 0 || req.Body == nil {
+		return nil
+	}
+	if req.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	encoding := t.RequestCompression[0]
+	return req.setCompressedBodyLevel(req.Body, encoding, t.requestCompressionLevel(encoding))
+}
+
+// requestCompressionLevel returns the configured level for encoding's
+// matching Transport field, or 0 (the library default) if it's unset or
+// encoding isn't recognized.
+func (t *Transport) requestCompressionLevel(encoding string) int {
+	switch encoding {
+	case "gzip":
+		return t.GzipLevel
+	case "deflate":
+		return t.DeflateLevel
+	case "br":
+		return t.BrotliLevel
+	case "zstd":
+		return t.ZstdLevel
+	default:
+		return 0
+	}
+}
@@ -1,8 +1,13 @@
 package http
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
+	"sync"
 
 	"github.com/andybalholm/brotli"
 	"github.com/klauspost/compress/flate"
@@ -19,41 +24,298 @@ const (
 	zlibLevelBest     = 0xDA
 )
 
+// sniffPeekBytes is how much of the body DecompressBody peeks at to
+// guess a missing or incorrect Content-Encoding. The gzip, zstd and
+// zlib magic numbers only need the first few bytes, but brotli has no
+// magic number at all, so guessing it requires actually attempting the
+// decode against a large-enough prefix to be confident.
+const sniffPeekBytes = 512
+
+// ContentDecoderFactory wraps body in a reader that decodes a single
+// Content-Encoding token. DecompressBody calls it as soon as the header
+// is processed; the built-in factories registered below return readers
+// that only touch body on their first Read, and a custom factory should
+// behave the same way.
+type ContentDecoderFactory func(body io.ReadCloser) io.ReadCloser
+
+var (
+	contentDecodersMu sync.RWMutex
+	contentDecoders   = map[string]ContentDecoderFactory{
+		"gzip":    func(body io.ReadCloser) io.ReadCloser { return &gzipReader{body: body} },
+		"br":      func(body io.ReadCloser) io.ReadCloser { return &brReader{body: body} },
+		"zstd":    func(body io.ReadCloser) io.ReadCloser { return &zstdReader{body: body} },
+		"deflate": func(body io.ReadCloser) io.ReadCloser { return &deflateAutoReader{body: body} },
+	}
+	// builtinContentDecoders tracks which tokens still use our built-in
+	// factory, so decompressBody knows it's safe to swap the zstd one
+	// for a window/memory-bounded variant when Transport limits are set.
+	// A RegisterContentDecoder call for that name clears the entry.
+	builtinContentDecoders = map[string]bool{"gzip": true, "br": true, "zstd": true, "deflate": true}
+)
+
+// RegisterContentDecoder registers a decoder for a Content-Encoding
+// token, so DecompressBody can undo it. It's safe to call concurrently,
+// and a later call for the same name replaces the earlier one (this is
+// how a caller overrides one of the built-in gzip/br/zstd/deflate
+// decoders too).
+func RegisterContentDecoder(name string, factory ContentDecoderFactory) {
+	contentDecodersMu.Lock()
+	defer contentDecodersMu.Unlock()
+	contentDecoders[name] = factory
+	delete(builtinContentDecoders, name)
+}
+
+func contentDecoder(name string) (factory ContentDecoderFactory, builtin bool, ok bool) {
+	contentDecodersMu.RLock()
+	defer contentDecodersMu.RUnlock()
+	factory, ok = contentDecoders[name]
+	return factory, builtinContentDecoders[name], ok
+}
+
+// decompressOptions configures decompressBody. The zero value reproduces
+// the long-standing manual DecompressBody(res) behavior: only act on an
+// explicit Content-Encoding header, with no size or ratio bound.
+type decompressOptions struct {
+	sniff                 bool
+	maxDecompressedBytes  int64
+	maxDecompressionRatio float64
+}
+
 func DecompressBody(res *Response) {
+	decompressBody(res, decompressOptions{})
+}
+
+func decompressBody(res *Response, opts decompressOptions) {
 	ce := res.Header.Get("Content-Encoding")
-	switch ce {
-	case "gzip":
-		res.Body = &gzipReader{body: res.Body}
-	case "br":
-		res.Body = &brReader{body: res.Body}
-	case "deflate":
-		// read zlib header
-		var header [2]byte
-		if _, err := io.ReadFull(res.Body, header[:]); err != nil {
+	if ce == "" && opts.sniff {
+		ce = sniffContentEncoding(res)
+		if ce == "" {
 			return
 		}
-		// reset body to include header
-		res.Body = io.NopCloser(io.MultiReader(bytes.NewReader(header[:]), res.Body))
-		// check for zlib header
-		if header[0] == zlibMethodDeflate && (header[1] == zlibLevelDefault || header[1] == zlibLevelLow || header[1] == zlibLevelMedium || header[1] == zlibLevelBest) {
-			res.Body = &zlibDeflateReader{body: res.Body}
-		} else if header[0] == zlibMethodDeflate {
-			res.Body = &deflateReader{body: res.Body}
-		}
+	}
+	if ce == "" {
 		return
-	case "zstd":
-		res.Body = &zstdReader{body: res.Body}
-	default:
+	}
+
+	bounded := opts.maxDecompressedBytes > 0 || opts.maxDecompressionRatio > 0
+	var src *countingReadCloser
+	body := res.Body
+	if bounded {
+		src = &countingReadCloser{ReadCloser: res.Body}
+		body = src
+	}
+
+	// RFC 9110 section 8.4.1: Content-Encoding lists codings in the order
+	// they were applied, so they must be undone in the reverse order.
+	tokens := strings.Split(ce, ",")
+	applied := false
+	for i := len(tokens) - 1; i >= 0; i-- {
+		name := strings.TrimSpace(tokens[i])
+		if name == "" || name == "identity" {
+			continue
+		}
+		factory, builtin, ok := contentDecoder(name)
+		if !ok {
+			res.Body = &decodeErrorReader{body: body, err: fmt.Errorf("fhttp: unknown Content-Encoding %q", name)}
+			return
+		}
+		applied = true
+		if name == "zstd" && builtin && opts.maxDecompressedBytes > 0 {
+			// WithDecoderMaxMemory/WithDecoderMaxWindow reject 0 outright,
+			// so only swap in the bounded decoder when a real byte cap is
+			// configured; MaxDecompressionRatio alone is still enforced
+			// below by decompressLimiter, without needing this.
+			body = newZstdReaderLimited(body, opts.maxDecompressedBytes)
+		} else {
+			body = factory(body)
+		}
+	}
+
+	if !applied {
+		// Content-Encoding was present but consisted only of "identity"
+		// (and/or empty) tokens, so nothing was actually decoded. Leave
+		// res untouched, including its original, accurate Content-Length.
 		return
 	}
+
+	if bounded {
+		body = &decompressLimiter{
+			body:     body,
+			src:      src,
+			maxBytes: opts.maxDecompressedBytes,
+			maxRatio: opts.maxDecompressionRatio,
+		}
+	}
+	res.Body = body
+
 	res.Header.Del("Content-Encoding")
 	res.Header.Del("Content-Length")
 	res.Uncompressed = true
 	res.ContentLength = -1
 }
 
-// gzipReader wraps a response body so it can lazily
-// call gzip.NewReader on the first call to Read
+// ErrDecompressionLimit is returned by a decompressed response body once
+// it exceeds a Transport-configured MaxDecompressedBytes or
+// MaxDecompressionRatio bound. It guards against zip-bomb-style
+// responses that would otherwise be decompressed into memory without
+// limit.
+var ErrDecompressionLimit = errors.New("fhttp: decompressed response exceeded the configured size or ratio limit")
+
+// countingReadCloser tracks how many compressed bytes have been read
+// from the underlying response body, so decompressLimiter can compute a
+// decompression ratio.
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decompressLimiter wraps the fully-assembled decoder chain and stops
+// once either bound configured on the owning Transport is exceeded.
+type decompressLimiter struct {
+	body     io.ReadCloser
+	src      *countingReadCloser
+	emitted  int64
+	maxBytes int64
+	maxRatio float64
+}
+
+func (l *decompressLimiter) Read(p []byte) (int, error) {
+	n, err := l.body.Read(p)
+	l.emitted += int64(n)
+	if l.maxBytes > 0 && l.emitted > l.maxBytes {
+		return n, ErrDecompressionLimit
+	}
+	if l.maxRatio > 0 && l.src.n > 0 && float64(l.emitted)/float64(l.src.n) > l.maxRatio {
+		return n, ErrDecompressionLimit
+	}
+	return n, err
+}
+
+func (l *decompressLimiter) Close() error {
+	return l.body.Close()
+}
+
+// decodeErrorReader reports err from Read once an unregistered
+// Content-Encoding token is encountered, while still closing the
+// partially-built decoder chain on Close.
+type decodeErrorReader struct {
+	body io.ReadCloser
+	err  error
+}
+
+func (d *decodeErrorReader) Read(p []byte) (int, error) {
+	return 0, d.err
+}
+
+func (d *decodeErrorReader) Close() error {
+	return d.body.Close()
+}
+
+// deflateAutoReader wraps a response body so it can lazily peek the
+// first two bytes on first Read to tell a zlib-wrapped deflate stream
+// (RFC 1950) from a raw deflate stream (RFC 1951), the same way
+// DecompressBody always has.
+type deflateAutoReader struct {
+	body io.ReadCloser
+	r    io.ReadCloser
+	err  error
+}
+
+func (d *deflateAutoReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.r == nil {
+		var header [2]byte
+		if _, err := io.ReadFull(d.body, header[:]); err != nil {
+			d.err = err
+			return 0, err
+		}
+		rest := io.NopCloser(io.MultiReader(bytes.NewReader(header[:]), d.body))
+		if header[0] == zlibMethodDeflate && isZlibFlagByte(header[1]) {
+			d.r = &zlibDeflateReader{body: rest}
+		} else {
+			d.r = &deflateReader{body: rest}
+		}
+	}
+	return d.r.Read(p)
+}
+
+func (d *deflateAutoReader) Close() error {
+	if d.r != nil {
+		// Returns the inner zlib/flate decoder to its pool.
+		d.r.Close()
+		d.r = nil
+	}
+	return d.body.Close()
+}
+
+// sniffContentEncoding peeks at the first bytes of res.Body and guesses
+// a Content-Encoding for servers that compress responses without
+// declaring it, such as transparent gzip proxies or RUM-style beacons.
+// decompressBody only calls it when Content-Encoding is absent; a
+// declared but incorrect Content-Encoding is not checked against the
+// body. The peeked bytes are restored onto
+// res.Body via io.MultiReader before returning, exactly like the
+// existing deflate header check above, so no data is lost.
+func sniffContentEncoding(res *Response) string {
+	br := bufio.NewReaderSize(res.Body, sniffPeekBytes)
+	peek, _ := br.Peek(sniffPeekBytes)
+	if len(peek) == 0 {
+		return ""
+	}
+	restored := append([]byte(nil), peek...)
+	res.Body = io.NopCloser(io.MultiReader(bytes.NewReader(restored), res.Body))
+
+	switch {
+	case len(peek) >= 2 && peek[0] == 0x1f && peek[1] == 0x8b:
+		return "gzip"
+	case len(peek) >= 4 && peek[0] == 0x28 && peek[1] == 0xb5 && peek[2] == 0x2f && peek[3] == 0xfd:
+		return "zstd"
+	case len(peek) >= 2 && peek[0] == zlibMethodDeflate && isZlibFlagByte(peek[1]):
+		return "deflate"
+	case looksLikeBrotli(peek):
+		return "br"
+	default:
+		// None of the above matched, so this is almost certainly a
+		// normal, uncompressed body (by far the common case for a
+		// missing Content-Encoding). Leave it alone rather than
+		// guessing; a wrong guess here would break every plain
+		// JSON/HTML/text response instead of only catching the rare
+		// mis-declared-encoding case this is meant for.
+		return ""
+	}
+}
+
+// looksLikeBrotli reports whether peek looks like the start of a valid
+// brotli stream. Brotli has no magic number, so the only reliable signal
+// is attempting the decode itself and checking it doesn't immediately
+// fail; an uncompressed body will almost always error out within the
+// first few bytes.
+func looksLikeBrotli(peek []byte) bool {
+	r := brotli.NewReader(bytes.NewReader(peek))
+	buf := make([]byte, 64)
+	_, err := r.Read(buf)
+	return err == nil || err == io.EOF
+}
+
+func isZlibFlagByte(b byte) bool {
+	return b == zlibLevelDefault || b == zlibLevelLow || b == zlibLevelMedium || b == zlibLevelBest
+}
+
+// gzipReaderPool reuses *gzip.Reader decoders across responses via
+// Reset, instead of paying for gzip.NewReader's allocations on every
+// compressed response.
+var gzipReaderPool = sync.Pool{New: func() any { return new(gzip.Reader) }}
+
+// gzipReader wraps a response body so it can lazily pull a pooled
+// *gzip.Reader on the first call to Read
 type gzipReader struct {
 	body io.ReadCloser
 	r    *gzip.Reader
@@ -65,8 +327,10 @@ func (gz *gzipReader) Read(p []byte) (n int, err error) {
 		return 0, gz.err
 	}
 	if gz.r == nil {
-		gz.r, err = gzip.NewReader(gz.body)
-		if err != nil {
+		gz.r = gzipReaderPool.Get().(*gzip.Reader)
+		if err = gz.r.Reset(gz.body); err != nil {
+			gzipReaderPool.Put(gz.r)
+			gz.r = nil
 			gz.err = err
 			return 0, err
 		}
@@ -75,11 +339,20 @@ func (gz *gzipReader) Read(p []byte) (n int, err error) {
 }
 
 func (gz *gzipReader) Close() error {
-	return gz.body.Close()
+	err := gz.body.Close()
+	if gz.r != nil {
+		gzipReaderPool.Put(gz.r)
+		gz.r = nil
+	}
+	return err
 }
 
-// brReader wraps a response body so it can lazily
-// call brotli.NewReader on the first call to Read
+// brotliReaderPool reuses *brotli.Reader decoders across responses via
+// Reset.
+var brotliReaderPool = sync.Pool{New: func() any { return brotli.NewReader(bytes.NewReader(nil)) }}
+
+// brReader wraps a response body so it can lazily pull a pooled
+// *brotli.Reader on the first call to Read
 type brReader struct {
 	body io.ReadCloser
 	r    *brotli.Reader
@@ -91,17 +364,33 @@ func (br *brReader) Read(p []byte) (n int, err error) {
 		return 0, br.err
 	}
 	if br.r == nil {
-		br.r = brotli.NewReader(br.body)
+		br.r = brotliReaderPool.Get().(*brotli.Reader)
+		if err = br.r.Reset(br.body); err != nil {
+			brotliReaderPool.Put(br.r)
+			br.r = nil
+			br.err = err
+			return 0, err
+		}
 	}
 	return br.r.Read(p)
 }
 
 func (br *brReader) Close() error {
-	return br.body.Close()
+	err := br.body.Close()
+	if br.r != nil {
+		brotliReaderPool.Put(br.r)
+		br.r = nil
+	}
+	return err
 }
 
-// zlibDeflateReader wraps a response body so it can lazily
-// call zlib.NewReader on the first call to Read
+// zlibReaderPool reuses the io.ReadCloser returned by zlib.NewReader
+// across responses. Its concrete type is unexported, but it implements
+// zlib.Resetter, which is all Reset needs.
+var zlibReaderPool = sync.Pool{}
+
+// zlibDeflateReader wraps a response body so it can lazily pull a pooled
+// zlib.NewReader decoder on the first call to Read
 type zlibDeflateReader struct {
 	body io.ReadCloser
 	r    io.ReadCloser
@@ -113,21 +402,38 @@ func (z *zlibDeflateReader) Read(p []byte) (n int, err error) {
 		return 0, z.err
 	}
 	if z.r == nil {
-		z.r, err = zlib.NewReader(z.body)
-		if err != nil {
-			z.err = err
-			return 0, z.err
+		if v := zlibReaderPool.Get(); v != nil {
+			zr := v.(io.ReadCloser)
+			if rs, ok := zr.(zlib.Resetter); ok && rs.Reset(z.body, nil) == nil {
+				z.r = zr
+			}
+		}
+		if z.r == nil {
+			z.r, err = zlib.NewReader(z.body)
+			if err != nil {
+				z.err = err
+				return 0, err
+			}
 		}
 	}
 	return z.r.Read(p)
 }
 
 func (z *zlibDeflateReader) Close() error {
-	return z.r.Close()
+	err := z.body.Close()
+	if z.r != nil {
+		zlibReaderPool.Put(z.r)
+		z.r = nil
+	}
+	return err
 }
 
-// deflateReader wraps a response body so it can lazily
-// call flate.NewReader on the first call to Read
+// flateReaderPool reuses the io.ReadCloser returned by flate.NewReader
+// across responses via its flate.Resetter interface.
+var flateReaderPool = sync.Pool{}
+
+// deflateReader wraps a response body so it can lazily pull a pooled
+// flate.NewReader decoder on the first call to Read
 type deflateReader struct {
 	body io.ReadCloser
 	r    io.ReadCloser
@@ -139,37 +445,105 @@ func (dr *deflateReader) Read(p []byte) (n int, err error) {
 		return 0, dr.err
 	}
 	if dr.r == nil {
-		dr.r = flate.NewReader(dr.body)
+		if v := flateReaderPool.Get(); v != nil {
+			fr := v.(io.ReadCloser)
+			if rs, ok := fr.(flate.Resetter); ok && rs.Reset(dr.body, nil) == nil {
+				dr.r = fr
+			}
+		}
+		if dr.r == nil {
+			dr.r = flate.NewReader(dr.body)
+		}
 	}
 	return dr.r.Read(p)
 }
 
 func (dr *deflateReader) Close() error {
-	return dr.r.Close()
+	err := dr.body.Close()
+	if dr.r != nil {
+		flateReaderPool.Put(dr.r)
+		dr.r = nil
+	}
+	return err
 }
 
-// zstdReader wraps a response body so it can lazily
-// call zstd.NewReader on the first call to Read
+// zstdDecoderPool reuses *zstd.Decoder instances, each of which owns a
+// pool of worker goroutines, across responses via Reset. Only decoders
+// created with the default options are pooled: a window/memory-limited
+// decoder bakes those bounds in at construction, so it can't safely be
+// handed to a later response with different (or no) limits.
+var zstdDecoderPool = sync.Pool{}
+
+// zstdReader wraps a response body so it can lazily pull a pooled
+// *zstd.Decoder on the first call to Read
 type zstdReader struct {
 	body io.ReadCloser
+	opts []zstd.DOption
 	r    *zstd.Decoder
 	err  error
 }
 
+// newZstdReaderLimited builds a zstdReader that caps the decoder's
+// window and working-memory size at maxBytes, on top of whatever bound
+// decompressLimiter applies to the decoded stream itself. A malicious
+// zstd frame header can otherwise request a window far bigger than the
+// compressed body would ever justify, so this is checked up front rather
+// than only after the fact.
+//
+// zstd can't decode a frame at all with less working memory than that
+// frame's window size, and every real zstd stream has a window of at
+// least zstd.MinWindowSize (1KB) even for tiny payloads. So below
+// MinWindowSize, WithDecoderMaxMemory/WithDecoderMaxWindow can't do
+// anything useful: they'd either fail construction outright, or reject
+// every ordinary zstd stream with a "window size exceeded" error instead
+// of the documented ErrDecompressionLimit. Skip both options below that
+// floor and rely solely on decompressLimiter, which still enforces the
+// real cap on the decoded output after the fact.
+func newZstdReaderLimited(body io.ReadCloser, maxBytes int64) io.ReadCloser {
+	var opts []zstd.DOption
+	if window := uint64(maxBytes); window >= zstd.MinWindowSize {
+		opts = []zstd.DOption{
+			zstd.WithDecoderMaxMemory(window),
+			zstd.WithDecoderMaxWindow(window),
+		}
+	}
+	return &zstdReader{
+		body: body,
+		opts: opts,
+	}
+}
+
 func (z *zstdReader) Read(p []byte) (n int, err error) {
 	if z.err != nil {
 		return 0, z.err
 	}
 	if z.r == nil {
-		z.r, err = zstd.NewReader(z.body)
-		if err != nil {
-			z.err = err
-			return 0, z.err
+		if len(z.opts) == 0 {
+			if v := zstdDecoderPool.Get(); v != nil {
+				z.r = v.(*zstd.Decoder)
+				if err = z.r.Reset(z.body); err != nil {
+					z.err = err
+					return 0, err
+				}
+			}
+		}
+		if z.r == nil {
+			z.r, err = zstd.NewReader(z.body, z.opts...)
+			if err != nil {
+				z.err = err
+				return 0, z.err
+			}
 		}
 	}
 	return z.r.Read(p)
 }
 
 func (z *zstdReader) Close() error {
-	return z.body.Close()
+	err := z.body.Close()
+	if z.r != nil && len(z.opts) == 0 {
+		z.r.Reset(nil)
+		zstdDecoderPool.Put(z.r)
+		z.r = nil
+	}
+	return err
 }
@@ -0,0 +1,102 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zeroReader is an io.Reader that produces an endless stream of zero
+// bytes, used only to build benchmark payloads.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func gzipPayload(tb testing.TB, n int) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := io.CopyN(w, zeroReader{}, int64(n)); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdPayload(tb testing.TB, n int) []byte {
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := io.CopyN(w, zeroReader{}, int64(n)); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func drain(r io.Reader, buf []byte) error {
+	for {
+		if _, err := r.Read(buf); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// BenchmarkGzipReaderPool exercises gzipReaderPool (see decompress.go)
+// under concurrent load, to demonstrate the win from reusing pooled
+// *gzip.Reader decoders instead of calling gzip.NewReader per response.
+// Run with -bench=. -cpu=1,4,16 to see the effect of pooling scale with
+// concurrency.
+func BenchmarkGzipReaderPool(b *testing.B) {
+	payload := gzipPayload(b, 64<<10)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, 32<<10)
+		for pb.Next() {
+			r := &gzipReader{body: io.NopCloser(bytes.NewReader(payload))}
+			if err := drain(r, buf); err != nil {
+				b.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkZstdReaderPool exercises zstdDecoderPool the same way;
+// zstd.NewReader is the most expensive of the four to allocate since it
+// spins up its own worker goroutines, so this is where pooling matters
+// most.
+func BenchmarkZstdReaderPool(b *testing.B) {
+	payload := zstdPayload(b, 64<<10)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, 32<<10)
+		for pb.Next() {
+			r := &zstdReader{body: io.NopCloser(bytes.NewReader(payload))}
+			if err := drain(r, buf); err != nil {
+				b.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
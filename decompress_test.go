@@ -0,0 +1,268 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+)
+
+func mustGzipCompress(tb testing.TB, p []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(p); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func mustZstdCompress(tb testing.TB, p []byte) []byte {
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := w.Write(p); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func mustBrotliCompress(tb testing.TB, p []byte) []byte {
+	var buf bytes.Buffer
+	w := brotli.NewWriter(&buf)
+	if _, err := w.Write(p); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func mustZlibCompress(tb testing.TB, p []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(p); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestResponse(body []byte, contentEncoding string) *Response {
+	h := make(Header)
+	if contentEncoding != "" {
+		h.Set("Content-Encoding", contentEncoding)
+	}
+	return &Response{
+		Header: h,
+		Body:   io.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+func TestSniffContentEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{"gzip", gzipPayload(t, 256), "gzip"},
+		{"zstd", zstdPayload(t, 256), "zstd"},
+		{"zlib deflate", mustZlibCompress(t, bytes.Repeat([]byte("a"), 256)), "deflate"},
+		{"brotli", mustBrotliCompress(t, bytes.Repeat([]byte("hello world "), 64)), "br"},
+		{"plain text", []byte("the quick brown fox jumps over the lazy dog"), ""},
+		{"empty", []byte{}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := newTestResponse(tt.body, "")
+			got := sniffContentEncoding(res)
+			if got != tt.want {
+				t.Fatalf("sniffContentEncoding() = %q, want %q", got, tt.want)
+			}
+
+			// The peeked bytes must be restored onto res.Body untouched,
+			// regardless of what was sniffed.
+			restored, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("reading restored body: %v", err)
+			}
+			if !bytes.Equal(restored, tt.body) {
+				t.Fatalf("sniffContentEncoding consumed the body: got %d bytes, want %d", len(restored), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestSniffContentEncodingNoFalsePositiveOnOrdinaryText(t *testing.T) {
+	// A guard against the regression this was originally shipped with:
+	// the sniffer must not unconditionally guess "br" for unrecognized
+	// leading bytes.
+	res := newTestResponse([]byte(`{"ok":true,"items":[1,2,3]}`), "")
+	if got := sniffContentEncoding(res); got != "" {
+		t.Fatalf("sniffContentEncoding() = %q for ordinary JSON, want \"\"", got)
+	}
+}
+
+// xorByte is a trivial, self-inverse "encoding" used only to exercise
+// RegisterContentDecoder and multi-token decode ordering, without
+// relying on a second real compression library.
+const xorByte = 0xff
+
+type xorReader struct {
+	body io.ReadCloser
+}
+
+func (x *xorReader) Read(p []byte) (int, error) {
+	n, err := x.body.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= xorByte
+	}
+	return n, err
+}
+
+func (x *xorReader) Close() error { return x.body.Close() }
+
+func xorBytes(p []byte) []byte {
+	out := make([]byte, len(p))
+	for i, b := range p {
+		out[i] = b ^ xorByte
+	}
+	return out
+}
+
+func TestDecompressBodyMultipleEncodingsDecodedInReverseOrder(t *testing.T) {
+	RegisterContentDecoder("xor-test", func(body io.ReadCloser) io.ReadCloser {
+		return &xorReader{body: body}
+	})
+
+	plain := []byte("the quick brown fox jumps over the lazy dog, 32 times over")
+	gzipped := mustGzipCompress(t, plain)
+	// Content-Encoding lists codings in application order: gzip was
+	// applied first, xor-test second (and thus outermost).
+	wire := xorBytes(gzipped)
+
+	res := newTestResponse(wire, "gzip, xor-test")
+	decompressBody(res, decompressOptions{})
+
+	got, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading decompressed body: %v", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("decompressBody() = %q, want %q", got, plain)
+	}
+	if res.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("Content-Encoding header not removed after decoding")
+	}
+	if !res.Uncompressed {
+		t.Fatalf("res.Uncompressed not set after decoding")
+	}
+}
+
+func TestRegisterContentDecoderOverridesBuiltin(t *testing.T) {
+	called := false
+	RegisterContentDecoder("gzip", func(body io.ReadCloser) io.ReadCloser {
+		called = true
+		return io.NopCloser(bytes.NewReader([]byte("overridden")))
+	})
+	defer RegisterContentDecoder("gzip", func(body io.ReadCloser) io.ReadCloser {
+		return &gzipReader{body: body}
+	})
+
+	res := newTestResponse(mustGzipCompress(t, []byte("irrelevant")), "gzip")
+	decompressBody(res, decompressOptions{})
+
+	if !called {
+		t.Fatalf("overriding factory for a builtin name was not used")
+	}
+	got, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading decompressed body: %v", err)
+	}
+	if string(got) != "overridden" {
+		t.Fatalf("decompressBody() = %q, want the overriding factory's output", got)
+	}
+}
+
+func TestDecompressBodyMaxDecompressedBytes(t *testing.T) {
+	plain := bytes.Repeat([]byte("a"), 4096)
+	res := newTestResponse(mustGzipCompress(t, plain), "gzip")
+	decompressBody(res, decompressOptions{maxDecompressedBytes: 1024})
+
+	_, err := io.ReadAll(res.Body)
+	if !errors.Is(err, ErrDecompressionLimit) {
+		t.Fatalf("io.ReadAll() err = %v, want ErrDecompressionLimit", err)
+	}
+}
+
+func TestDecompressBodyMaxDecompressionRatio(t *testing.T) {
+	// Highly compressible input: a large run of zero bytes compresses to
+	// a tiny gzip stream, well over the configured ratio.
+	plain := make([]byte, 1<<20)
+	res := newTestResponse(mustGzipCompress(t, plain), "gzip")
+	decompressBody(res, decompressOptions{maxDecompressionRatio: 10})
+
+	_, err := io.ReadAll(res.Body)
+	if !errors.Is(err, ErrDecompressionLimit) {
+		t.Fatalf("io.ReadAll() err = %v, want ErrDecompressionLimit", err)
+	}
+}
+
+func TestDecompressBodyWithinLimitsSucceeds(t *testing.T) {
+	plain := bytes.Repeat([]byte("a"), 256)
+	res := newTestResponse(mustGzipCompress(t, plain), "gzip")
+	decompressBody(res, decompressOptions{maxDecompressedBytes: 1 << 20, maxDecompressionRatio: 1000})
+
+	got, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("io.ReadAll() err = %v, want nil", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("decompressBody() = %q, want %q", got, plain)
+	}
+}
+
+func TestNewZstdReaderLimitedBelowMinWindowSize(t *testing.T) {
+	// A small, perfectly reasonable byte cap must not fail zstd decoder
+	// construction outright; decompressLimiter enforces the real cap.
+	plain := bytes.Repeat([]byte("a"), 256)
+	res := newTestResponse(mustZstdCompress(t, plain), "zstd")
+	decompressBody(res, decompressOptions{maxDecompressedBytes: 100})
+
+	_, err := io.ReadAll(res.Body)
+	if !errors.Is(err, ErrDecompressionLimit) {
+		t.Fatalf("io.ReadAll() err = %v, want ErrDecompressionLimit", err)
+	}
+}
+
+func TestDecompressBodyIdentityOnlyLeavesResponseUntouched(t *testing.T) {
+	res := newTestResponse([]byte("plain body"), "identity")
+	res.ContentLength = 10
+	decompressBody(res, decompressOptions{})
+
+	if res.Uncompressed {
+		t.Fatalf("Uncompressed set for an identity-only Content-Encoding")
+	}
+	if res.Header.Get("Content-Encoding") != "identity" {
+		t.Fatalf("Content-Encoding header stripped for an identity-only encoding")
+	}
+	if res.ContentLength != 10 {
+		t.Fatalf("ContentLength mutated for an identity-only encoding: got %d", res.ContentLength)
+	}
+}
@@ -0,0 +1,44 @@
+package http
+
+// acceptEncodingAll advertises every Content-Encoding DecompressBody can
+// undo out of the box, in the order this client prefers them.
+const acceptEncodingAll = "gzip, deflate, br, zstd"
+
+// negotiateAcceptEncoding sets an Accept-Encoding header advertising
+// every encoding this package knows how to decode, unless the caller
+// already supplied their own (important for TLS-fingerprinting users of
+// this fork who craft headers to match a specific browser) or
+// compression has been turned off.
+func (t *Transport) negotiateAcceptEncoding(req *Request) {
+	if t.DisableCompression || !t.autoDecompressEnabled() {
+		return
+	}
+	if req.Header.Get("Accept-Encoding") != "" {
+		return
+	}
+	req.Header.Set("Accept-Encoding", acceptEncodingAll)
+}
+
+// autoDecompressEnabled reports whether Transport should negotiate
+// Accept-Encoding and decompress responses automatically. AutoDecompress
+// is a *bool, rather than a bool, so a Transport left at its zero value
+// still defaults to enabled; set it to a pointer to false to go back to
+// calling DecompressBody manually.
+func (t *Transport) autoDecompressEnabled() bool {
+	return t.AutoDecompress == nil || *t.AutoDecompress
+}
+
+// autoDecompressResponse runs on every response before RoundTrip hands
+// it back to the caller. It's equivalent to calling DecompressBody(res)
+// by hand, except it also honors whatever SniffContentEncoding and
+// MaxDecompressed* bounds this Transport has configured.
+func (t *Transport) autoDecompressResponse(res *Response) {
+	if t.DisableCompression || !t.autoDecompressEnabled() {
+		return
+	}
+	decompressBody(res, decompressOptions{
+		sniff:                 t.SniffContentEncoding,
+		maxDecompressedBytes:  t.MaxDecompressedBytes,
+		maxDecompressionRatio: t.MaxDecompressionRatio,
+	})
+}
@@ -0,0 +1,94 @@
+package http
+
+import "net/http"
+
+// Transport configures and performs HTTP round trips. The TLS
+// fingerprinting, connection pooling and dialing logic that make this a
+// "fhttp" fork rather than a thin net/http wrapper live in the rest of
+// this package's files, which aren't part of this checkout; this file
+// only declares the compression-related configuration that
+// compress.go, decompress.go and negotiate.go need, plus a RoundTrip
+// that delegates the actual network I/O to net/http.Transport so those
+// helpers are reachable end to end.
+type Transport struct {
+	// RequestCompression lists Content-Encodings ("gzip", "deflate",
+	// "br", "zstd") for Transport to automatically apply to an outgoing
+	// request body that doesn't already have a Content-Encoding set.
+	// Only the first entry is used; later entries are not consulted,
+	// even when the first is not a supported encoding (RoundTrip then
+	// returns an error). It's the request-side counterpart to the
+	// automatic Accept-Encoding negotiation Transport does for
+	// responses; leaving it empty (the default) leaves request bodies
+	// untouched.
+	RequestCompression []string
+
+	// GzipLevel, DeflateLevel, BrotliLevel and ZstdLevel override the
+	// compression level used for the matching encoding by automatic
+	// RequestCompression. 0 keeps each library's own default level.
+	// SetCompressedBody does not read these fields and always uses the
+	// default level.
+	GzipLevel    int
+	DeflateLevel int
+	BrotliLevel  int
+	ZstdLevel    int
+
+	// DisableCompression, when true, turns off both automatic
+	// Accept-Encoding negotiation and automatic response decompression.
+	DisableCompression bool
+
+	// AutoDecompress controls whether Transport negotiates
+	// Accept-Encoding and decompresses responses automatically. It's a
+	// *bool, rather than a bool, so a Transport left at its zero value
+	// still defaults to enabled; set it to a pointer to false to go back
+	// to calling DecompressBody manually.
+	AutoDecompress *bool
+
+	// SniffContentEncoding enables best-effort Content-Encoding
+	// detection for responses that omit the header. A response that
+	// declares an incorrect Content-Encoding is decoded as declared, not
+	// sniffed. See sniffContentEncoding in decompress.go.
+	SniffContentEncoding bool
+
+	// MaxDecompressedBytes and MaxDecompressionRatio bound how much a
+	// single response may expand under decompression, guarding against
+	// zip-bomb-style responses. See decompressLimiter in decompress.go.
+	MaxDecompressedBytes  int64
+	MaxDecompressionRatio float64
+
+	// std performs the actual network I/O that this checkout's
+	// decompression/compression helpers wrap. See the type doc comment
+	// above.
+	std http.Transport
+}
+
+// RoundTrip sends req and returns its response, applying this package's
+// automatic request compression and response decompression around the
+// underlying net/http round trip.
+func (t *Transport) RoundTrip(req *Request) (*Response, error) {
+	t.negotiateAcceptEncoding(req)
+	if err := t.compressRequestBody(req); err != nil {
+		return nil, err
+	}
+
+	stdReq, err := http.NewRequest(req.Method, req.URL.String(), req.Body)
+	if err != nil {
+		return nil, err
+	}
+	stdReq.Header = req.Header
+	stdReq.ContentLength = req.ContentLength
+
+	stdRes, err := t.std.RoundTrip(stdReq)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Response{
+		StatusCode:    stdRes.StatusCode,
+		Header:        stdRes.Header,
+		Body:          stdRes.Body,
+		ContentLength: stdRes.ContentLength,
+		Request:       req,
+	}
+	t.autoDecompressResponse(res)
+	return res, nil
+}
@@ -0,0 +1,38 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Header is this package's header type. It's an alias of net/http.Header
+// so ordinary net/http headers pass through unchanged; the parts of this
+// fork that need their own method set attach those methods to Request
+// and Response instead, which are local types rather than aliases.
+type Header = http.Header
+
+// Request is this package's client request type. This checkout only
+// carries the fields the compression helpers in compress.go and
+// transport.go touch; the rest of this fork's Request (proto, trailers,
+// TLS and connection state, header-order overrides, ...) lives in the
+// files that define the full HTTP client, which aren't part of this
+// snapshot.
+type Request struct {
+	Method        string
+	URL           *url.URL
+	Header        Header
+	Body          io.ReadCloser
+	ContentLength int64
+}
+
+// Response is this package's client response type, scoped the same way
+// as Request above.
+type Response struct {
+	StatusCode    int
+	Header        Header
+	Body          io.ReadCloser
+	ContentLength int64
+	Uncompressed  bool
+	Request       *Request
+}